@@ -0,0 +1,234 @@
+package network
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/luscis/openlan/pkg/libol"
+)
+
+// cidrTrie is a small binary radix tree keyed on the bits of a netip.Prefix,
+// one tree per address family. Lookup walks from the root following the
+// address bits and remembers the last rule seen, giving longest-prefix-match
+// semantics without needing a full BART-style multi-bit table.
+type cidrTrie struct {
+	root *trieNode
+	bits int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	has      bool
+	allow    bool
+}
+
+func newCidrTrie(bits int) *cidrTrie {
+	return &cidrTrie{root: &trieNode{}, bits: bits}
+}
+
+func (t *cidrTrie) insert(prefix netip.Prefix, allow bool) {
+	addr := prefix.Addr()
+	n := t.root
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addrBit(addr, i)
+		if n.children[bit] == nil {
+			n.children[bit] = &trieNode{}
+		}
+		n = n.children[bit]
+	}
+	n.has = true
+	n.allow = allow
+}
+
+// lookup returns the rule of the longest matching prefix, if any.
+func (t *cidrTrie) lookup(addr netip.Addr) (matched bool, allow bool) {
+	n := t.root
+	if n.has {
+		matched, allow = true, n.allow
+	}
+	for i := 0; i < t.bits; i++ {
+		bit := addrBit(addr, i)
+		if n.children[bit] == nil {
+			break
+		}
+		n = n.children[bit]
+		if n.has {
+			matched, allow = true, n.allow
+		}
+	}
+	return matched, allow
+}
+
+func addrBit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	byteIdx := i / 8
+	if byteIdx >= len(b) {
+		return 0
+	}
+	shift := 7 - uint(i%8)
+	return int((b[byteIdx] >> shift) & 1)
+}
+
+// insideList is a remote_allow_list override keyed by an inside CIDR, used
+// for per-site-to-site traffic rules.
+type insideList struct {
+	prefix netip.Prefix
+	trie4  *cidrTrie
+	trie6  *cidrTrie
+}
+
+// ACL evaluates allow/deny rules for a network via longest-prefix-match
+// lookups, uniformly over IPv4 and IPv6.
+type ACL struct {
+	name string
+	out  *libol.SubLogger
+
+	lock sync.RWMutex
+
+	allow4  *cidrTrie
+	allow6  *cidrTrie
+	remote4 *cidrTrie
+	remote6 *cidrTrie
+	inside  []*insideList
+}
+
+func NewACL(name string) *ACL {
+	return &ACL{
+		name:    name,
+		out:     libol.NewSubLogger(name + ":acl"),
+		allow4:  newCidrTrie(32),
+		allow6:  newCidrTrie(128),
+		remote4: newCidrTrie(32),
+		remote6: newCidrTrie(128),
+	}
+}
+
+// InsideRules carries the per-inside-CIDR remote_allow_list overrides used
+// for site-to-site traffic, keyed by the inside CIDR they apply to.
+type InsideRules map[string]map[string]bool
+
+// Load rebuilds the trie from scratch out of the raw CIDR:bool rule maps
+// found on co.Network, so a config reload simply calls Load again.
+func (a *ACL) Load(allowList, remoteAllowList map[string]bool, inside InsideRules) {
+	allow4 := newCidrTrie(32)
+	allow6 := newCidrTrie(128)
+	remote4 := newCidrTrie(32)
+	remote6 := newCidrTrie(128)
+
+	fill := func(t4, t6 *cidrTrie, rules map[string]bool) {
+		for cidr, allow := range rules {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				a.out.Warn("ACL.Load: invalid cidr %s", cidr)
+				continue
+			}
+			if prefix.Addr().Is4() {
+				t4.insert(prefix, allow)
+			} else {
+				t6.insert(prefix, allow)
+			}
+		}
+	}
+	fill(allow4, allow6, allowList)
+	fill(remote4, remote6, remoteAllowList)
+
+	insideLists := make([]*insideList, 0, len(inside))
+	for cidr, rules := range inside {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			a.out.Warn("ACL.Load: invalid inside cidr %s", cidr)
+			continue
+		}
+		il := &insideList{prefix: prefix, trie4: newCidrTrie(32), trie6: newCidrTrie(128)}
+		fill(il.trie4, il.trie6, rules)
+		insideLists = append(insideLists, il)
+	}
+	// Longest (most specific) inside prefix must win when two overrides
+	// overlap, so sort once here rather than leaving insideOverride to pick
+	// whichever entry map iteration handed it first.
+	sort.Slice(insideLists, func(i, j int) bool {
+		return insideLists[i].prefix.Bits() > insideLists[j].prefix.Bits()
+	})
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.allow4, a.allow6 = allow4, allow6
+	a.remote4, a.remote6 = remote4, remote6
+	a.inside = insideLists
+}
+
+// insideOverride returns the most specific (longest-prefix) override that
+// contains inside. a.inside is sorted longest-prefix-first by Load, so the
+// first containing entry found here is always the right one.
+func (a *ACL) insideOverride(inside netip.Addr) *insideList {
+	for _, il := range a.inside {
+		if il.prefix.Contains(inside) {
+			return il
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether traffic from remote, destined for inside, is
+// permitted. Missing rules default to allow unless an explicit-deny
+// ancestor prefix matched.
+func (a *ACL) Allowed(remote netip.Addr, inside netip.Addr) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if il := a.insideOverride(inside); il != nil {
+		trie := il.trie4
+		if remote.Is6() {
+			trie = il.trie6
+		}
+		if matched, allow := trie.lookup(remote); matched {
+			return allow
+		}
+	}
+
+	remoteTrie := a.remote4
+	allowTrie := a.allow4
+	if remote.Is6() {
+		remoteTrie = a.remote6
+	}
+	if inside.Is6() {
+		allowTrie = a.allow6
+	}
+
+	if matched, allow := remoteTrie.lookup(remote); matched {
+		return allow
+	}
+	if matched, allow := allowTrie.lookup(inside); matched {
+		return allow
+	}
+	return true
+}
+
+// AllowedRemote evaluates remote against the remote_allow_list axis alone,
+// for callers that program a remote-source ipset independently of any
+// inside-destination decision.
+func (a *ACL) AllowedRemote(remote netip.Addr) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	trie := a.remote4
+	if remote.Is6() {
+		trie = a.remote6
+	}
+	matched, allow := trie.lookup(remote)
+	return !matched || allow
+}
+
+// AllowedInside evaluates inside against the allow_list axis alone, for
+// callers that program an inside-destination ipset independently of any
+// remote-source decision.
+func (a *ACL) AllowedInside(inside netip.Addr) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	trie := a.allow4
+	if inside.Is6() {
+		trie = a.allow6
+	}
+	matched, allow := trie.lookup(inside)
+	return !matched || allow
+}
@@ -0,0 +1,222 @@
+package network
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func mustPrefix(t *testing.T, s string) netip.Prefix {
+	t.Helper()
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		t.Fatalf("ParsePrefix(%s): %s", s, err)
+	}
+	return p
+}
+
+func mustAddr(t *testing.T, s string) netip.Addr {
+	t.Helper()
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		t.Fatalf("ParseAddr(%s): %s", s, err)
+	}
+	return a
+}
+
+func TestCidrTrieLongestPrefixMatch(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []struct {
+			cidr  string
+			allow bool
+		}
+		addr        string
+		wantMatched bool
+		wantAllow   bool
+	}{
+		{
+			name: "no rules",
+			addr: "10.0.0.1",
+		},
+		{
+			name: "exact match allow",
+			rules: []struct {
+				cidr  string
+				allow bool
+			}{{"10.0.0.0/24", true}},
+			addr:        "10.0.0.1",
+			wantMatched: true,
+			wantAllow:   true,
+		},
+		{
+			name: "longest prefix wins over broader deny",
+			rules: []struct {
+				cidr  string
+				allow bool
+			}{{"10.0.0.0/8", false}, {"10.0.0.0/24", true}},
+			addr:        "10.0.0.1",
+			wantMatched: true,
+			wantAllow:   true,
+		},
+		{
+			name: "outside any rule is unmatched",
+			rules: []struct {
+				cidr  string
+				allow bool
+			}{{"10.0.0.0/24", true}},
+			addr: "10.0.1.1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			trie := newCidrTrie(32)
+			for _, r := range c.rules {
+				trie.insert(mustPrefix(t, r.cidr), r.allow)
+			}
+			matched, allow := trie.lookup(mustAddr(t, c.addr))
+			if matched != c.wantMatched {
+				t.Fatalf("matched = %v, want %v", matched, c.wantMatched)
+			}
+			if matched && allow != c.wantAllow {
+				t.Fatalf("allow = %v, want %v", allow, c.wantAllow)
+			}
+		})
+	}
+}
+
+func TestCidrTrieLongestPrefixMatchIPv6(t *testing.T) {
+	trie := newCidrTrie(128)
+	trie.insert(mustPrefix(t, "2001:db8::/32"), false)
+	trie.insert(mustPrefix(t, "2001:db8:1::/48"), true)
+
+	if matched, allow := trie.lookup(mustAddr(t, "2001:db8:1::1")); !matched || !allow {
+		t.Fatalf("longest /48 should win: matched=%v allow=%v", matched, allow)
+	}
+	if matched, allow := trie.lookup(mustAddr(t, "2001:db8:2::1")); !matched || allow {
+		t.Fatalf("broader /32 deny should apply: matched=%v allow=%v", matched, allow)
+	}
+	if matched, _ := trie.lookup(mustAddr(t, "2001:db9::1")); matched {
+		t.Fatal("outside any rule should be unmatched")
+	}
+}
+
+func TestACLAllowedDefaultsToAllow(t *testing.T) {
+	a := NewACL("test")
+	a.Load(nil, nil, nil)
+	if !a.Allowed(mustAddr(t, "192.168.1.1"), mustAddr(t, "192.168.2.1")) {
+		t.Fatal("Allowed() with no rules should default to true")
+	}
+	if !a.Allowed(mustAddr(t, "2001:db8::1"), mustAddr(t, "2001:db8:1::1")) {
+		t.Fatal("Allowed() with no rules should default to true for IPv6")
+	}
+}
+
+func TestACLAllowedRemoteAxis(t *testing.T) {
+	a := NewACL("test")
+	a.Load(nil, map[string]bool{
+		"10.0.0.0/24":   false,
+		"2001:db8::/32": false,
+	}, nil)
+	if a.AllowedRemote(mustAddr(t, "10.0.0.5")) {
+		t.Fatal("AllowedRemote() should deny 10.0.0.5 per remote_allow_list")
+	}
+	if !a.AllowedRemote(mustAddr(t, "10.0.1.5")) {
+		t.Fatal("AllowedRemote() should allow addresses outside the deny rule")
+	}
+	if a.AllowedRemote(mustAddr(t, "2001:db8::5")) {
+		t.Fatal("AllowedRemote() should deny 2001:db8::5 per remote_allow_list")
+	}
+	if !a.AllowedRemote(mustAddr(t, "2001:db9::5")) {
+		t.Fatal("AllowedRemote() should allow IPv6 addresses outside the deny rule")
+	}
+}
+
+func TestACLAllowedInsideAxis(t *testing.T) {
+	a := NewACL("test")
+	a.Load(map[string]bool{
+		"192.168.1.0/24": false,
+		"2001:db8::/32":  false,
+	}, nil, nil)
+	if a.AllowedInside(mustAddr(t, "192.168.1.5")) {
+		t.Fatal("AllowedInside() should deny 192.168.1.5 per allow_list")
+	}
+	if !a.AllowedInside(mustAddr(t, "192.168.2.5")) {
+		t.Fatal("AllowedInside() should allow addresses outside the deny rule")
+	}
+	if a.AllowedInside(mustAddr(t, "2001:db8::5")) {
+		t.Fatal("AllowedInside() should deny 2001:db8::5 per allow_list")
+	}
+	if !a.AllowedInside(mustAddr(t, "2001:db9::5")) {
+		t.Fatal("AllowedInside() should allow IPv6 addresses outside the deny rule")
+	}
+}
+
+func TestACLAllowedInsideOverride(t *testing.T) {
+	a := NewACL("test")
+	a.Load(
+		map[string]bool{"192.168.1.0/24": true},
+		map[string]bool{"10.0.0.0/8": true},
+		InsideRules{
+			"192.168.1.0/24": {"10.0.0.0/24": false},
+		},
+	)
+
+	if a.Allowed(mustAddr(t, "10.0.0.5"), mustAddr(t, "192.168.1.5")) {
+		t.Fatal("Allowed() should apply the inside override and deny 10.0.0.5")
+	}
+	if !a.Allowed(mustAddr(t, "10.1.0.5"), mustAddr(t, "192.168.1.5")) {
+		t.Fatal("Allowed() should fall through to the network-wide lists for remotes the override doesn't mention")
+	}
+	if !a.Allowed(mustAddr(t, "10.0.0.5"), mustAddr(t, "192.168.2.5")) {
+		t.Fatal("Allowed() should not apply the override outside its inside prefix")
+	}
+}
+
+func TestACLAllowedInsideOverrideIPv6(t *testing.T) {
+	a := NewACL("test")
+	a.Load(
+		map[string]bool{"2001:db8:1::/48": true},
+		map[string]bool{"2001:db8:dead::/48": true},
+		InsideRules{
+			"2001:db8:1::/48": {"2001:db8:dead::/48": false},
+		},
+	)
+
+	if a.Allowed(mustAddr(t, "2001:db8:dead::1"), mustAddr(t, "2001:db8:1::1")) {
+		t.Fatal("Allowed() should apply the IPv6 inside override and deny the remote")
+	}
+	if !a.Allowed(mustAddr(t, "2001:db8:beef::1"), mustAddr(t, "2001:db8:1::1")) {
+		t.Fatal("Allowed() should fall through to the network-wide lists for remotes the override doesn't mention")
+	}
+}
+
+func TestACLInsideOverrideLongestPrefixWins(t *testing.T) {
+	a := NewACL("test")
+	a.Load(
+		nil, nil,
+		InsideRules{
+			"10.0.0.0/8":  {"192.168.0.0/16": false},
+			"10.0.1.0/24": {"192.168.0.0/16": true},
+		},
+	)
+
+	if !a.Allowed(mustAddr(t, "192.168.1.1"), mustAddr(t, "10.0.1.5")) {
+		t.Fatal("Allowed() should apply the more specific /24 override (allow), not the broader /8 (deny)")
+	}
+	if a.Allowed(mustAddr(t, "192.168.1.1"), mustAddr(t, "10.0.2.5")) {
+		t.Fatal("Allowed() should fall back to the broader /8 override (deny) outside the /24")
+	}
+}
+
+func TestACLLoadIsConcurrencySafe(t *testing.T) {
+	a := NewACL("test")
+	a.Load(map[string]bool{"10.0.0.0/8": true}, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		a.Load(map[string]bool{"10.0.0.0/8": false}, nil, nil)
+		close(done)
+	}()
+	_ = a.AllowedInside(mustAddr(t, "10.0.0.1"))
+	<-done
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/luscis/openlan/pkg/libol"
+	"github.com/vishvananda/netlink"
+)
+
+// Bridger abstracts the bridge backend a network's ports attach to, so
+// WorkerImpl can attach ports to either a Linux kernel bridge or an Open
+// vSwitch bridge; WorkerImpl still checks for *OvsCtl where VLAN and
+// tunnel ports are set up differently. VLAN tagging and GRE/VXLAN
+// tunnels are modelled as bridge-level operations because OVS programs
+// them as port attributes rather than as separate kernel links.
+type Bridger interface {
+	Name() string
+	AddPort(port string) error
+	DelPort(port string) error
+	AddVlan(port string, vlan int) error
+	AddTunnel(port, kind, remote string, vni, dport int) error
+	DelTunnel(port string) error
+}
+
+// NewBridger selects a Bridger implementation for the given bridge.driver,
+// defaulting to the Linux kernel bridge so existing configs are unchanged.
+func NewBridger(driver, name string) Bridger {
+	if driver == "ovs" {
+		return NewOvsCtl(name)
+	}
+	return NewBrCtl(name, 0)
+}
+
+// BrCtl drives a Linux kernel bridge directly via netlink.
+type BrCtl struct {
+	name string
+	stp  int
+	out  *libol.SubLogger
+}
+
+func NewBrCtl(name string, stp int) *BrCtl {
+	return &BrCtl{
+		name: name,
+		stp:  stp,
+		out:  libol.NewSubLogger(name + ":brctl"),
+	}
+}
+
+func (b *BrCtl) Name() string {
+	return b.name
+}
+
+func (b *BrCtl) AddPort(port string) error {
+	br, err := netlink.LinkByName(b.name)
+	if err != nil {
+		b.out.Error("BrCtl.AddPort: %s %s", b.name, err)
+		return err
+	}
+	link, err := netlink.LinkByName(port)
+	if err != nil {
+		b.out.Error("BrCtl.AddPort: %s %s", port, err)
+		return err
+	}
+	if err := netlink.LinkSetMaster(link, br); err != nil {
+		b.out.Error("BrCtl.AddPort: %s %s", port, err)
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func (b *BrCtl) DelPort(port string) error {
+	link, err := netlink.LinkByName(port)
+	if err != nil {
+		b.out.Warn("BrCtl.DelPort: %s %s", port, err)
+		return err
+	}
+	return netlink.LinkSetNoMaster(link)
+}
+
+// AddVlan and AddTunnel are no-ops for the Linux backend: the caller
+// creates a netlink.Vlan sub-interface or Gretap/Vxlan link itself and
+// attaches it with AddPort like any other port.
+func (b *BrCtl) AddVlan(port string, vlan int) error {
+	return nil
+}
+
+func (b *BrCtl) AddTunnel(port, kind, remote string, vni, dport int) error {
+	return nil
+}
+
+func (b *BrCtl) DelTunnel(port string) error {
+	return nil
+}
+
+// OvsCtl drives an Open vSwitch bridge via ovs-vsctl.
+type OvsCtl struct {
+	name string
+	out  *libol.SubLogger
+}
+
+func NewOvsCtl(name string) *OvsCtl {
+	return &OvsCtl{
+		name: name,
+		out:  libol.NewSubLogger(name + ":ovs"),
+	}
+}
+
+func (o *OvsCtl) Name() string {
+	return o.name
+}
+
+func (o *OvsCtl) AddPort(port string) error {
+	if out, err := libol.Exec("ovs-vsctl", "--may-exist", "add-port", o.name, port); err != nil {
+		o.out.Error("OvsCtl.AddPort: %s %s", out, err)
+		return err
+	}
+	return nil
+}
+
+func (o *OvsCtl) DelPort(port string) error {
+	if out, err := libol.Exec("ovs-vsctl", "--if-exists", "del-port", o.name, port); err != nil {
+		o.out.Warn("OvsCtl.DelPort: %s %s", out, err)
+		return err
+	}
+	return nil
+}
+
+// AddVlan tags an already-attached port instead of creating a
+// netlink.Vlan sub-interface.
+func (o *OvsCtl) AddVlan(port string, vlan int) error {
+	tag := fmt.Sprintf("tag=%d", vlan)
+	if out, err := libol.Exec("ovs-vsctl", "set", "port", port, tag); err != nil {
+		o.out.Error("OvsCtl.AddVlan: %s %s", out, err)
+		return err
+	}
+	return nil
+}
+
+// AddTunnel wires a GRE or VXLAN remote as an OVS tunnel port instead of a
+// kernel netlink.Gretap/Vxlan link. dport is only meaningful for vxlan and
+// selects the tunnel's destination UDP port, mirroring the kernel
+// netlink.Vxlan backend's optional custom port; 0 leaves OVS's default.
+func (o *OvsCtl) AddTunnel(port, kind, remote string, vni, dport int) error {
+	args := []string{
+		"add-port", o.name, port, "--", "set", "interface", port,
+		fmt.Sprintf("type=%s", kind),
+		fmt.Sprintf("options:remote_ip=%s", remote),
+	}
+	if kind == "vxlan" {
+		args = append(args, fmt.Sprintf("options:key=%d", vni))
+		if dport > 0 {
+			args = append(args, fmt.Sprintf("options:dst_port=%d", dport))
+		}
+	}
+	if out, err := libol.Exec("ovs-vsctl", args...); err != nil {
+		o.out.Error("OvsCtl.AddTunnel: %s %s", out, err)
+		return err
+	}
+	return nil
+}
+
+func (o *OvsCtl) DelTunnel(port string) error {
+	return o.DelPort(port)
+}
@@ -0,0 +1,233 @@
+package cswitch
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luscis/openlan/pkg/cache"
+	"github.com/luscis/openlan/pkg/libol"
+	"github.com/luscis/openlan/pkg/models"
+	"github.com/luscis/openlan/pkg/schema"
+)
+
+// DiagnosticServer is an opt-in debug HTTP endpoint, bound to loopback
+// unless another listen address is given, that
+// dumps live internal state -- cached networks and leases, worker outputs,
+// firewall rules, IPSec tunnel SAs and ipset membership -- plus a handful
+// of targeted write endpoints for on-demand actions. It defaults off and
+// is guarded by a shared X-Token header when a token is configured (an
+// empty token accepts every request), so it is safe to ship disabled in
+// production builds and only switched on with --diagnostic.
+type DiagnosticServer struct {
+	out    *libol.SubLogger
+	listen string
+	token  string
+	server *http.Server
+}
+
+func NewDiagnosticServer(listen, token string) *DiagnosticServer {
+	if listen == "" {
+		listen = "127.0.0.1:10088"
+	}
+	return &DiagnosticServer{
+		out:    libol.NewSubLogger("diagnostic"),
+		listen: listen,
+		token:  token,
+	}
+}
+
+func (d *DiagnosticServer) authorized(r *http.Request) bool {
+	if d.token == "" {
+		return true
+	}
+	token := r.Header.Get("X-Token")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+func (d *DiagnosticServer) writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		d.out.Warn("DiagnosticServer.writeJSON: %s", err)
+	}
+}
+
+func (d *DiagnosticServer) handle(mux *http.ServeMux, pattern string, fn http.HandlerFunc) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fn(w, r)
+	})
+}
+
+func (d *DiagnosticServer) getNetworks(w http.ResponseWriter, r *http.Request) {
+	out := make([]*models.Network, 0, 32)
+	for n := range cache.Network.List() {
+		if n == nil {
+			break
+		}
+		out = append(out, n)
+	}
+	d.writeJSON(w, out)
+}
+
+func (d *DiagnosticServer) getLeases(w http.ResponseWriter, r *http.Request) {
+	out := make([]*schema.Lease, 0, 32)
+	for l := range cache.Network.ListLease() {
+		if l == nil {
+			break
+		}
+		out = append(out, l)
+	}
+	d.writeJSON(w, out)
+}
+
+func (d *DiagnosticServer) getOutputs(w http.ResponseWriter, r *http.Request) {
+	type output struct {
+		Network string `json:"network"`
+		Name    string `json:"name"`
+		Link    string `json:"link"`
+		Vlan    int    `json:"vlan"`
+	}
+	out := make([]output, 0, 32)
+	ListWorker(func(worker Networker) {
+		for _, port := range worker.Outputs() {
+			out = append(out, output{
+				Network: worker.String(),
+				Name:    port.name,
+				Link:    port.link,
+				Vlan:    port.vlan,
+			})
+		}
+	})
+	d.writeJSON(w, out)
+}
+
+func (d *DiagnosticServer) getFirewall(w http.ResponseWriter, r *http.Request) {
+	type firewall struct {
+		IpTables string `json:"iptables"`
+		IpSet    string `json:"ipset"`
+	}
+	out := firewall{}
+	if data, err := libol.Exec("iptables-save"); err != nil {
+		d.out.Warn("DiagnosticServer.getFirewall: %s", err)
+	} else {
+		out.IpTables = string(data)
+	}
+	if data, err := libol.Exec("ipset", "list"); err != nil {
+		d.out.Warn("DiagnosticServer.getFirewall: %s", err)
+	} else {
+		out.IpSet = string(data)
+	}
+	d.writeJSON(w, out)
+}
+
+func (d *DiagnosticServer) getTunnels(w http.ResponseWriter, r *http.Request) {
+	type tunnel struct {
+		Network string             `json:"network"`
+		Name    string             `json:"name"`
+		Tunnel  schema.IPSecTunnel `json:"tunnel"`
+		SA      *SAState           `json:"sa,omitempty"`
+	}
+	out := make([]tunnel, 0, 8)
+	ListIPSecWorkers(func(name string, worker *IPSecWorker) {
+		worker.ListTunnels(func(tunName string, obj schema.IPSecTunnel) {
+			obj.Secret = ""
+			out = append(out, tunnel{Network: name, Name: tunName, Tunnel: obj})
+		})
+		worker.ListSAs(func(tunName string, sa SAState) {
+			for i := range out {
+				if out[i].Network == name && out[i].Name == tunName {
+					state := sa
+					out[i].SA = &state
+				}
+			}
+		})
+	})
+	d.writeJSON(w, out)
+}
+
+func (d *DiagnosticServer) postLeaseRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/leases/"), "/")
+	if len(parts) != 3 || parts[2] != "renew" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	network, alias := parts[0], parts[1]
+	lease := cache.Network.NewLease(alias, network)
+	if lease == nil {
+		http.Error(w, "lease not found", http.StatusNotFound)
+		return
+	}
+	d.writeJSON(w, lease)
+}
+
+func (d *DiagnosticServer) postTunnelRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tunnels/"), "/")
+	if len(parts) != 2 || parts[1] != "restart" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	name := parts[0]
+	found := false
+	ListIPSecWorkers(func(_ string, worker *IPSecWorker) {
+		if found {
+			return
+		}
+		if worker.RestartTunnelByName(name) {
+			found = true
+		}
+	})
+	if !found {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *DiagnosticServer) Start() {
+	mux := http.NewServeMux()
+	d.handle(mux, "/networks", d.getNetworks)
+	d.handle(mux, "/leases", d.getLeases)
+	d.handle(mux, "/outputs", d.getOutputs)
+	d.handle(mux, "/firewall", d.getFirewall)
+	d.handle(mux, "/tunnels", d.getTunnels)
+	d.handle(mux, "/leases/", d.postLeaseRenew)
+	d.handle(mux, "/tunnels/", d.postTunnelRestart)
+
+	d.server = &http.Server{
+		Addr:    d.listen,
+		Handler: mux,
+	}
+	d.out.Info("DiagnosticServer.Start %s", d.listen)
+	go func() {
+		if err := d.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			d.out.Error("DiagnosticServer.Start: %s", err)
+		}
+	}()
+}
+
+func (d *DiagnosticServer) Stop() {
+	if d.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.server.Shutdown(ctx); err != nil {
+		d.out.Warn("DiagnosticServer.Stop: %s", err)
+	}
+	d.server = nil
+}
@@ -1,208 +1,393 @@
 package cswitch
 
 import (
-	"fmt"
-	"os"
-	"text/template"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/luscis/openlan/pkg/api"
 	co "github.com/luscis/openlan/pkg/config"
 	"github.com/luscis/openlan/pkg/libol"
 	"github.com/luscis/openlan/pkg/schema"
+	"github.com/strongswan/govici/vici"
 )
 
+const (
+	ViciSocket = "/var/run/charon.vici"
+)
+
+// SAState holds the runtime state of an IKE/CHILD SA pair, as reported by
+// strongSwan over Vici for a single tunnel.
+type SAState struct {
+	IkeState   string
+	IkeRekey   string
+	ChildState string
+	ChildRekey string
+	BytesIn    uint64
+	BytesOut   uint64
+}
+
 type IPSecWorker struct {
 	*WorkerImpl
-	spec *co.IPSecSpecifies
+	spec  *co.IPSecSpecifies
+	vici  *vici.Session
+	lock  sync.Mutex
+	state map[string]*SAState
 }
 
+var ipsecWorkers = make(map[string]*IPSecWorker)
+
 func NewIPSecWorker(c *co.Network) *IPSecWorker {
 	w := &IPSecWorker{
 		WorkerImpl: NewWorkerApi(c),
+		state:      make(map[string]*SAState),
 	}
 	w.spec, _ = c.Specifies.(*co.IPSecSpecifies)
+	ipsecWorkers[c.Name] = w
 	return w
 }
 
-const (
-	vxlanTmpl = `
-conn {{ .Name }}
-    keyexchange=ike
-    ikev2=no
-    type=transport
-    left={{ .Left }}
-{{- if .LeftPort }}
-    leftikeport={{ .LeftPort }}
-{{- end }}
-    right={{ .Right }}
-{{- if .RightPort }}
-    rightikeport={{ .RightPort }}
-{{- end }}
-    authby=secret
-
-conn {{ .Name }}-c1
-    auto=add
-    also={{ .Name }}
-{{- if .LeftId }}
-    leftid=@c1.{{ .LeftId }}
-{{- end }}
-{{- if .RightId }}
-    rightid=@c2.{{ .RightId }}
-{{- end }}
-    leftprotoport=udp/8472
-    rightprotoport=udp
-
-conn {{ .Name }}-c2
-    auto=add
-    also={{ .Name }}
-{{- if .LeftId }}
-    leftid=@c2.{{ .LeftId }}
-{{- end }}
-{{- if .RightId }}
-    rightid=@c1.{{ .RightId }}
-{{- end }}
-    leftprotoport=udp
-    rightprotoport=udp/8472
-`
-	greTmpl = `
-conn {{ .Name }}-c1
-    auto=add
-    ikev2=no
-    type=transport
-    left={{ .Left }}
-{{- if .LeftPort }}
-    leftikeport={{ .LeftPort }}
-{{- end }}
-{{- if .LeftId }}
-    leftid=@{{ .LeftId }}
-{{- end }}
-    right={{ .Right }}
-{{- if .RightId }}
-    rightid=@{{ .RightId }}
-{{- end }}
-{{- if .RightPort }}
-    rightikeport={{ .RightPort }}
-{{- end }}
-    authby=secret
-    leftprotoport=gre
-    rightprotoport=gre
-`
-	secretTmpl = `
-%any {{ .Right }} : PSK "{{ .Secret }}"
-`
-)
+// ListIPSecWorkers iterates every configured IPSecWorker, keyed by its
+// owning network name.
+func ListIPSecWorkers(call func(name string, w *IPSecWorker)) {
+	for name, w := range ipsecWorkers {
+		call(name, w)
+	}
+}
 
 func (w *IPSecWorker) Initialize() {
 	w.out.Info("IPSecWorker.Initialize")
 }
 
-func (w *IPSecWorker) saveSec(name, tmpl string, data interface{}) error {
-	file := fmt.Sprintf("/etc/ipsec.d/%s", name)
-	out, err := libol.CreateFile(file)
-	if err != nil || out == nil {
+func (w *IPSecWorker) connect() (*vici.Session, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.vici != nil {
+		return w.vici, nil
+	}
+	session, err := vici.NewSession(vici.WithSocketPath(ViciSocket))
+	if err != nil {
+		w.out.Error("IPSecWorker.connect: %s", err)
+		return nil, err
+	}
+	w.vici = session
+	return w.vici, nil
+}
+
+func (w *IPSecWorker) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.vici != nil {
+		w.vici.Close()
+		w.vici = nil
+	}
+}
+
+func connName(tun *co.IPSecTunnel, suffix string) string {
+	if suffix == "" {
+		return tun.Name
+	}
+	return tun.Name + "-" + suffix
+}
+
+func (w *IPSecWorker) loadConn(tun *co.IPSecTunnel, suffix, leftId, rightId, leftProto, rightProto string) error {
+	session, err := w.connect()
+	if err != nil {
 		return err
 	}
-	defer out.Close()
-	if obj, err := template.New("main").Parse(tmpl); err != nil {
+	child := map[string]interface{}{
+		"local_ts":  []string{leftProto},
+		"remote_ts": []string{rightProto},
+	}
+	local := map[string]interface{}{
+		"auth": "psk",
+	}
+	if leftId != "" {
+		local["id"] = leftId
+	}
+	remote := map[string]interface{}{
+		"auth": "psk",
+	}
+	if rightId != "" {
+		remote["id"] = rightId
+	}
+	conn := map[string]interface{}{
+		"local_addrs":  []string{tun.Left},
+		"remote_addrs": []string{tun.Right},
+		"version":      "1",
+		"children": map[string]interface{}{
+			connName(tun, suffix): child,
+		},
+		"local":  local,
+		"remote": remote,
+	}
+	if tun.LeftPort != 0 {
+		conn["local_port"] = tun.LeftPort
+	}
+	if tun.RightPort != 0 {
+		conn["remote_port"] = tun.RightPort
+	}
+	msg := vici.NewMessage()
+	if err := msg.Set(connName(tun, suffix), conn); err != nil {
+		return err
+	}
+	if _, err := session.CommandRequest("load-conn", msg); err != nil {
+		w.out.Error("IPSecWorker.loadConn: %s", err)
 		return err
-	} else {
-		if err := obj.Execute(out, data); err != nil {
-			return err
-		}
 	}
 	return nil
 }
 
-func (w *IPSecWorker) startConn(name string) {
+func (w *IPSecWorker) loadSecret(tun *co.IPSecTunnel) error {
+	session, err := w.connect()
+	if err != nil {
+		return err
+	}
+	msg := vici.NewMessage()
+	if err := msg.Set("type", "IKE"); err != nil {
+		return err
+	}
+	if err := msg.Set("data", tun.Secret); err != nil {
+		return err
+	}
+	if err := msg.Set("owners", []string{tun.Left, tun.Right}); err != nil {
+		return err
+	}
+	if _, err := session.CommandRequest("load-shared", msg); err != nil {
+		w.out.Error("IPSecWorker.loadSecret: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (w *IPSecWorker) initiate(name, child string) {
 	promise := libol.NewPromise()
 	promise.Go(func() error {
-		if out, err := libol.Exec("ipsec", "auto", "--start", "--asynchronous", name); err != nil {
-			w.out.Warn("IPSecWorker.startConn: %v %s", out, err)
+		session, err := w.connect()
+		if err != nil {
 			return err
 		}
-		w.out.Info("IPSecWorker.startConn: %v success", name)
+		msg := vici.NewMessage()
+		_ = msg.Set("child", child)
+		msg.Set("ike", name)
+		if _, err := session.CommandRequest("initiate", msg); err != nil {
+			w.out.Warn("IPSecWorker.initiate: %v %s", name, err)
+			return err
+		}
+		w.out.Info("IPSecWorker.initiate: %v success", name)
 		return nil
 	})
 }
 
+func (w *IPSecWorker) terminate(name string) {
+	session, err := w.connect()
+	if err != nil {
+		return
+	}
+	msg := vici.NewMessage()
+	_ = msg.Set("ike", name)
+	if _, err := session.CommandRequest("terminate", msg); err != nil {
+		w.out.Warn("IPSecWorker.terminate: %v %s", name, err)
+	}
+}
+
 func (w *IPSecWorker) restartTunnel(tun *co.IPSecTunnel) {
-	name := tun.Name
 	if tun.Transport == "vxlan" {
-		w.startConn(name + "-c1")
-		w.startConn(name + "-c2")
+		name := connName(tun, "c1")
+		w.terminate(name)
+		w.initiate(name, name)
+		name = connName(tun, "c2")
+		w.terminate(name)
+		w.initiate(name, name)
 	} else if tun.Transport == "gre" {
-		w.startConn(name + "-c1")
+		name := connName(tun, "c1")
+		w.terminate(name)
+		w.initiate(name, name)
 	}
 }
 
 func (w *IPSecWorker) addTunnel(tun *co.IPSecTunnel) error {
-	connTmpl := ""
-	secTmpl := ""
-
-	name := tun.Name
-	if tun.Transport == "vxlan" {
-		connTmpl = vxlanTmpl
-		secTmpl = secretTmpl
-	} else if tun.Transport == "gre" {
-		connTmpl = greTmpl
-		secTmpl = secretTmpl
+	if err := w.loadSecret(tun); err != nil {
+		w.out.Error("WorkerImpl.AddTunnel %s", err)
+		return err
 	}
-
-	if secTmpl != "" {
-		if err := w.saveSec(name+".secrets", secTmpl, tun); err != nil {
+	if tun.Transport == "vxlan" {
+		if err := w.loadConn(tun, "c1", "@c1."+tun.LeftId, "@c2."+tun.RightId, "udp/8472", "udp"); err != nil {
 			w.out.Error("WorkerImpl.AddTunnel %s", err)
 			return err
 		}
-		libol.Exec("ipsec", "auto", "--rereadsecrets")
-	}
-	if connTmpl != "" {
-		if err := w.saveSec(name+".conf", connTmpl, tun); err != nil {
+		if err := w.loadConn(tun, "c2", "@c2."+tun.LeftId, "@c1."+tun.RightId, "udp", "udp/8472"); err != nil {
+			w.out.Error("WorkerImpl.AddTunnel %s", err)
+			return err
+		}
+		w.restartTunnel(tun)
+	} else if tun.Transport == "gre" {
+		if err := w.loadConn(tun, "c1", "@"+tun.LeftId, "@"+tun.RightId, "gre", "gre"); err != nil {
 			w.out.Error("WorkerImpl.AddTunnel %s", err)
 			return err
 		}
 		w.restartTunnel(tun)
 	}
-
 	return nil
 }
 
+// watchEvents dials charon and subscribes to SA lifecycle events, retrying
+// with a fixed backoff whenever the session can't be established or dies
+// later on, so a charon restart or a cold start before charon is up don't
+// leave the worker permanently blind to SA state.
+func (w *IPSecWorker) watchEvents() {
+	session, err := w.connect()
+	if err != nil {
+		time.Sleep(time.Second)
+		go w.watchEvents()
+		return
+	}
+	events := []string{"ike-updown", "child-updown"}
+	if err := session.Listen(events...); err != nil {
+		w.out.Warn("IPSecWorker.watchEvents: %s", err)
+		w.close()
+		time.Sleep(time.Second)
+		go w.watchEvents()
+		return
+	}
+	go func() {
+		for {
+			msg, event, err := session.NextEvent()
+			if err != nil {
+				w.out.Warn("IPSecWorker.watchEvents: %s", err)
+				// The session is dead (charon restart, socket drop, etc).
+				// Drop it so the next connect() re-dials, and restart the
+				// watch loop on the fresh session instead of going quiet.
+				w.close()
+				time.Sleep(time.Second)
+				w.watchEvents()
+				return
+			}
+			w.onEvent(event, msg)
+		}
+	}()
+}
+
+// pickChildSA picks one CHILD_SA entry out of ike's child-sas map to report
+// state/byte-counters for. A rekey briefly leaves more than one entry
+// present, so prefer the live INSTALLED one over the dying/rekeying one
+// rather than whichever Go's map iteration happens to yield first; if none
+// is INSTALLED (all rekeying/deleting), fall back to the lexicographically
+// first name so the choice is at least deterministic across calls.
+func pickChildSA(ike map[string]interface{}) map[string]interface{} {
+	childSAs, _ := ike["child-sas"].(map[string]interface{})
+	if len(childSAs) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(childSAs))
+	for name := range childSAs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fallback map[string]interface{}
+	for _, name := range names {
+		child, ok := childSAs[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if fallback == nil {
+			fallback = child
+		}
+		if state, _ := child["state"].(string); state == "INSTALLED" {
+			return child
+		}
+	}
+	return fallback
+}
+
+func (w *IPSecWorker) onEvent(event string, msg *vici.Message) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, key := range msg.Keys() {
+		ike, ok := msg.Get(key).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		state := w.state[key]
+		if state == nil {
+			state = &SAState{}
+			w.state[key] = state
+		}
+		if event == "ike-updown" {
+			if v, ok := ike["state"].(string); ok {
+				state.IkeState = v
+			}
+			if v, ok := ike["rekey-time"].(string); ok {
+				state.IkeRekey = v
+			}
+		} else if event == "child-updown" {
+			if child := pickChildSA(ike); child != nil {
+				if v, ok := child["state"].(string); ok {
+					state.ChildState = v
+				}
+				if v, ok := child["rekey-time"].(string); ok {
+					state.ChildRekey = v
+				}
+				if v, ok := child["bytes-in"].(string); ok {
+					if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+						state.BytesIn = n
+					}
+				}
+				if v, ok := child["bytes-out"].(string); ok {
+					if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+						state.BytesOut = n
+					}
+				}
+			}
+		}
+		w.out.Info("IPSecWorker.onEvent: %s %s -> %v", event, key, state)
+	}
+}
+
 func (w *IPSecWorker) Start(v api.Switcher) {
 	w.uuid = v.UUID()
 	w.out.Info("IPSecWorker.Start")
+	w.watchEvents()
 	for _, tun := range w.spec.Tunnels {
 		w.addTunnel(tun)
 	}
 }
 
 func (w *IPSecWorker) removeTunnel(tun *co.IPSecTunnel) error {
-	name := tun.Name
+	session, err := w.connect()
+	if err != nil {
+		return err
+	}
 	if tun.Transport == "vxlan" {
-		libol.Exec("ipsec", "auto", "--delete", "--asynchronous", name+"-c1")
-		libol.Exec("ipsec", "auto", "--delete", "--asynchronous", name+"-c2")
+		w.terminate(connName(tun, "c1"))
+		w.terminate(connName(tun, "c2"))
+		session.CommandRequest("unload-conn", msgWithName(connName(tun, "c1")))
+		session.CommandRequest("unload-conn", msgWithName(connName(tun, "c2")))
 	} else if tun.Transport == "gre" {
-		libol.Exec("ipsec", "auto", "--delete", "--asynchronous", name+"-c1")
-	}
-	cfile := fmt.Sprintf("/etc/ipsec.d/%s.conf", name)
-	sfile := fmt.Sprintf("/etc/ipsec.d/%s.secrets", name)
-
-	if err := libol.FileExist(cfile); err == nil {
-		if err := os.Remove(cfile); err != nil {
-			w.out.Warn("IPSecWorker.RemoveTunnel %s", err)
-		}
-	}
-	if err := libol.FileExist(sfile); err == nil {
-		if err := os.Remove(sfile); err != nil {
-			w.out.Warn("IPSecWorker.RemoveTunnel %s", err)
-		}
+		w.terminate(connName(tun, "c1"))
+		session.CommandRequest("unload-conn", msgWithName(connName(tun, "c1")))
 	}
+	w.lock.Lock()
+	delete(w.state, connName(tun, "c1"))
+	delete(w.state, connName(tun, "c2"))
+	w.lock.Unlock()
 	return nil
 }
 
+func msgWithName(name string) *vici.Message {
+	msg := vici.NewMessage()
+	_ = msg.Set("name", name)
+	return msg
+}
+
 func (w *IPSecWorker) Stop() {
 	w.out.Info("IPSecWorker.Stop")
 	for _, tun := range w.spec.Tunnels {
 		w.removeTunnel(tun)
 	}
+	w.close()
 }
 
 func (w *IPSecWorker) Reload(v api.Switcher) {
@@ -254,7 +439,37 @@ func (w *IPSecWorker) RestartTunnel(data schema.IPSecTunnel) {
 	}
 }
 
-func (w *IPSecWorker) ListTunnels(call func(obj schema.IPSecTunnel)) {
+// RestartTunnelByName restarts a tunnel by its configured name rather than
+// by matching Left/Right/Secret/Transport, for callers such as the
+// diagnostic endpoint that only know the name.
+func (w *IPSecWorker) RestartTunnelByName(name string) bool {
+	for _, tun := range w.spec.Tunnels {
+		if tun.Name == name {
+			w.restartTunnel(tun)
+			return true
+		}
+	}
+	return false
+}
+
+// saFor returns the most recently observed SA state for one of a tunnel's
+// underlying connections, preferring the c1 leg when both exist.
+func (w *IPSecWorker) saFor(tun *co.IPSecTunnel) *SAState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if state, ok := w.state[connName(tun, "c1")]; ok {
+		return state
+	}
+	if state, ok := w.state[connName(tun, "c2")]; ok {
+		return state
+	}
+	return nil
+}
+
+// ListTunnels reports every configured tunnel keyed by its name, mirroring
+// ListSAs so callers can join the two by tunnel identity rather than by
+// network alone.
+func (w *IPSecWorker) ListTunnels(call func(name string, obj schema.IPSecTunnel)) {
 	for _, tun := range w.spec.Tunnels {
 		obj := schema.IPSecTunnel{
 			Left:      tun.Left,
@@ -266,6 +481,16 @@ func (w *IPSecWorker) ListTunnels(call func(obj schema.IPSecTunnel)) {
 			Secret:    tun.Secret,
 			Transport: tun.Transport,
 		}
-		call(obj)
+		call(tun.Name, obj)
+	}
+}
+
+// ListSAs reports the runtime IKE/CHILD SA state observed over Vici for
+// every configured tunnel, keyed by tunnel name.
+func (w *IPSecWorker) ListSAs(call func(name string, sa SAState)) {
+	for _, tun := range w.spec.Tunnels {
+		if sa := w.saFor(tun); sa != nil {
+			call(tun.Name, *sa)
+		}
 	}
 }
@@ -0,0 +1,269 @@
+package cswitch
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/luscis/openlan/pkg/api"
+	co "github.com/luscis/openlan/pkg/config"
+	cn "github.com/luscis/openlan/pkg/network"
+	"github.com/luscis/openlan/pkg/schema"
+	"github.com/vishvananda/netlink"
+)
+
+// LBWorker programs the kernel IPVS director to expose service VIPs
+// backed by a pool of real servers, steering matching packets into IPVS
+// via a fwmark mangle rule and a dummy link that owns the VIPs.
+type LBWorker struct {
+	*WorkerImpl
+	spec  *co.LBSpecifies
+	ipvs  *cn.IPVSCtl
+	dummy netlink.Link
+	// backendSets holds the per-VIP ipset of real backend addresses that
+	// the SNAT rule matches on, since return traffic from a backend
+	// egresses via the network bridge, never the dummy link that only
+	// anchors the VIP.
+	backendSets map[string]*cn.IPSet
+}
+
+func NewLBWorker(c *co.Network) *LBWorker {
+	w := &LBWorker{
+		WorkerImpl:  NewWorkerApi(c),
+		backendSets: make(map[string]*cn.IPSet),
+	}
+	w.spec, _ = c.Specifies.(*co.LBSpecifies)
+	return w
+}
+
+func (w *LBWorker) Initialize() {
+	w.WorkerImpl.Initialize()
+	w.out.Info("LBWorker.Initialize")
+	w.ipvs = cn.NewIPVSCtl(w.cfg.Name)
+}
+
+func lbDummyName(name string) string {
+	return fmt.Sprintf("lb-%s", name)
+}
+
+func (w *LBWorker) addDummy() {
+	name := lbDummyName(w.cfg.Name)
+	link := &netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		w.out.Error("LBWorker.addDummy: %s %s", name, err)
+		return
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		w.out.Warn("LBWorker.addDummy: %s %s", name, err)
+	}
+	w.dummy = link
+}
+
+func (w *LBWorker) delDummy() {
+	if w.dummy == nil {
+		return
+	}
+	name := lbDummyName(w.cfg.Name)
+	link := &netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		w.out.Warn("LBWorker.delDummy: %s %s", name, err)
+	}
+	w.dummy = nil
+}
+
+func toLBService(svc *co.LBService) *cn.LBService {
+	lb := &cn.LBService{
+		Name:          svc.VIP,
+		VIP:           svc.VIP,
+		Protocol:      svc.Protocol,
+		Port:          uint16(svc.Port),
+		FWMark:        uint32(fwMark(svc)),
+		Scheduler:     cn.Scheduler(svc.Scheduler),
+		StickyTimeout: svc.StickyTimeout,
+	}
+	for _, b := range svc.Backends {
+		lb.Backends = append(lb.Backends, &cn.LBBackend{
+			Address: b.Address,
+			Port:    uint16(b.Port),
+			Weight:  b.Weight,
+		})
+	}
+	return lb
+}
+
+// fwMark derives a stable fwmark for a service from the VIP+protocol+port
+// tuple (not the port alone, which two VIPs sharing a port would collide
+// on), used to steer matching packets into IPVS; the SNAT rule matches on
+// the backend ipset instead. The top bit is cleared so the mark never prints as a negative
+// iptables/ipvsadm value.
+func fwMark(svc *co.LBService) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%s:%d", svc.VIP, svc.Protocol, svc.Port)
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// lbBackendSetName names the ipset that tracks a service's live backend
+// addresses, used to match SNAT return traffic regardless of which
+// interface it actually egresses via.
+func lbBackendSetName(networkName, vip string) string {
+	return fmt.Sprintf("lb_%s_%s", networkName, strings.ReplaceAll(vip, ".", "_"))
+}
+
+func (w *LBWorker) addService(svc *co.LBService) error {
+	if w.dummy != nil {
+		if addr, err := netlink.ParseAddr(svc.VIP + "/32"); err == nil {
+			if err := netlink.AddrAdd(w.dummy, addr); err != nil {
+				w.out.Warn("LBWorker.addService: AddrAdd %s %s", svc.VIP, err)
+			}
+		}
+	}
+
+	mark := fwMark(svc)
+	w.fire.Mangle.Pre.AddRule(cn.IpRule{
+		Dest:    svc.VIP,
+		Proto:   svc.Protocol,
+		Match:   svc.Protocol,
+		DstPort: fmt.Sprintf("%d", svc.Port),
+		Jump:    "MARK",
+		SetMark: mark,
+		Comment: "lb-" + svc.VIP,
+	})
+
+	set := cn.NewIPSet(lbBackendSetName(w.cfg.Name, svc.VIP), "hash:ip")
+	for _, b := range svc.Backends {
+		if out, err := set.Add(b.Address); err != nil {
+			w.out.Warn("LBWorker.addService: ipset add %s %s %s", b.Address, out, err)
+		}
+	}
+	w.backendSets[svc.VIP] = set
+	w.fire.Nat.Post.AddRule(cn.IpRule{
+		DestSet: set.Name,
+		Jump:    cn.CMasq,
+		Comment: "lb-return-" + svc.VIP,
+	})
+
+	return w.ipvs.AddService(toLBService(svc))
+}
+
+func (w *LBWorker) delService(svc *co.LBService) {
+	if err := w.ipvs.DelService(toLBService(svc)); err != nil {
+		w.out.Warn("LBWorker.delService: %s", err)
+	}
+	if set, ok := w.backendSets[svc.VIP]; ok {
+		set.Destroy()
+		delete(w.backendSets, svc.VIP)
+	}
+}
+
+func (w *LBWorker) Start(v api.Switcher) {
+	w.uuid = v.UUID()
+	w.out.Info("LBWorker.Start")
+	w.addDummy()
+	for _, svc := range w.spec.Services {
+		w.addService(svc)
+	}
+	w.fire.Start()
+}
+
+func (w *LBWorker) Stop() {
+	w.out.Info("LBWorker.Stop")
+	w.fire.Stop()
+	for _, svc := range w.spec.Services {
+		w.delService(svc)
+	}
+	w.delDummy()
+	w.ipvs.Close()
+}
+
+func (w *LBWorker) Reload(v api.Switcher) {
+	w.Stop()
+	w.Initialize()
+	w.Start(v)
+}
+
+func (w *LBWorker) AddService(data schema.LBService) {
+	cfg := &co.LBService{
+		VIP:           data.VIP,
+		Protocol:      data.Protocol,
+		Port:          data.Port,
+		Scheduler:     data.Scheduler,
+		StickyTimeout: data.StickyTimeout,
+	}
+	if w.spec.AddService(cfg) {
+		w.addService(cfg)
+	}
+}
+
+func (w *LBWorker) DelService(data schema.LBService) {
+	cfg := &co.LBService{VIP: data.VIP, Protocol: data.Protocol, Port: data.Port}
+	if svc, removed := w.spec.DelService(cfg); removed {
+		w.delService(svc)
+	}
+}
+
+func (w *LBWorker) AddBackend(vip string, data schema.LBBackend) {
+	svc, index := w.spec.FindService(vip)
+	if index == -1 {
+		return
+	}
+	backend := &co.LBBackend{Address: data.Address, Port: data.Port, Weight: data.Weight}
+	if w.spec.AddBackend(svc, backend) {
+		if err := w.ipvs.AddBackend(toLBService(svc), &cn.LBBackend{
+			Address: backend.Address,
+			Port:    uint16(backend.Port),
+			Weight:  backend.Weight,
+		}); err != nil {
+			w.out.Warn("LBWorker.AddBackend: %s", err)
+		}
+		if set, ok := w.backendSets[vip]; ok {
+			if out, err := set.Add(backend.Address); err != nil {
+				w.out.Warn("LBWorker.AddBackend: ipset add %s %s %s", backend.Address, out, err)
+			}
+		}
+	}
+}
+
+func (w *LBWorker) DelBackend(vip string, data schema.LBBackend) {
+	svc, index := w.spec.FindService(vip)
+	if index == -1 {
+		return
+	}
+	backend := &co.LBBackend{Address: data.Address, Port: data.Port}
+	if removed := w.spec.DelBackend(svc, backend); removed {
+		if err := w.ipvs.DelBackend(toLBService(svc), &cn.LBBackend{
+			Address: backend.Address,
+			Port:    uint16(backend.Port),
+		}); err != nil {
+			w.out.Warn("LBWorker.DelBackend: %s", err)
+		}
+		if set, ok := w.backendSets[vip]; ok {
+			if out, err := set.Del(backend.Address); err != nil {
+				w.out.Warn("LBWorker.DelBackend: ipset del %s %s %s", backend.Address, out, err)
+			}
+		}
+	}
+}
+
+func (w *LBWorker) ListServices(call func(obj schema.LBService)) {
+	for _, svc := range w.spec.Services {
+		obj := schema.LBService{
+			VIP:           svc.VIP,
+			Protocol:      svc.Protocol,
+			Port:          svc.Port,
+			Scheduler:     svc.Scheduler,
+			StickyTimeout: svc.StickyTimeout,
+		}
+		for _, b := range svc.Backends {
+			obj.Backends = append(obj.Backends, schema.LBBackend{
+				Address: b.Address,
+				Port:    b.Port,
+				Weight:  b.Weight,
+			})
+		}
+		call(obj)
+	}
+}
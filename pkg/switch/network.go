@@ -2,6 +2,7 @@ package _switch
 
 import (
 	"fmt"
+	"net/netip"
 	"strconv"
 	"strings"
 
@@ -23,6 +24,7 @@ type Networker interface {
 	Subnet() string
 	Reload(v api.Switcher)
 	Provider() string
+	Outputs() []*LinuxPort
 }
 
 var workers = make(map[string]Networker)
@@ -62,15 +64,23 @@ type LinuxPort struct {
 }
 
 type WorkerImpl struct {
-	uuid    string
-	cfg     *co.Network
-	out     *libol.SubLogger
-	dhcp    *Dhcp
-	outputs []*LinuxPort
-	fire    *cn.FireWallTable
-	setR    *cn.IPSet
-	setV    *cn.IPSet
-	vpn     *OpenVPN
+	uuid          string
+	cfg           *co.Network
+	out           *libol.SubLogger
+	dhcp          *Dhcp
+	outputs       []*LinuxPort
+	fire          *cn.FireWallTable
+	setR          *cn.IPSet
+	setV          *cn.IPSet
+	vpn           *OpenVPN
+	acl           *cn.ACL
+	aclRemoteSet  *cn.IPSet
+	aclInsideSet  *cn.IPSet
+	aclRemote     map[string]bool
+	aclInside     map[string]bool
+	aclOverride   map[string]*cn.IPSet
+	aclOverRemote map[string]map[string]bool
+	bridger       cn.Bridger
 }
 
 func NewWorkerApi(c *co.Network) *WorkerImpl {
@@ -94,6 +104,7 @@ func (w *WorkerImpl) Initialize() {
 			Bridge: w.cfg.Bridge,
 		})
 	}
+	w.bridger = cn.NewBridger(w.cfg.Bridge.Driver, w.cfg.Bridge.Name)
 	w.fire = cn.NewFireWallTable(w.cfg.Name)
 	if out, err := w.setV.Clear(); err != nil {
 		w.out.Error("WorkImpl.Initialize: create ipset: %s %s", out, err)
@@ -103,7 +114,185 @@ func (w *WorkerImpl) Initialize() {
 	}
 }
 
+// initACL builds the allow/deny trie out of the network's allow_list and
+// remote_allow_list blocks and the per-inside-CIDR overrides, a no-op when
+// none of them is configured. The two
+// lists are kept on separate ipsets/rules since they gate different
+// address axes: remote_allow_list restricts which remote sources may
+// forward into this bridge, allow_list restricts which inside
+// destinations bridge-local traffic may reach. The FORWARD rules that
+// reference those two ipsets are installed once here, not on every
+// reload; a hot-reload changes ipset membership and, for an inside CIDR
+// whose override was not seen before, adds that override's FORWARD rule.
+func (w *WorkerImpl) initACL() {
+	cfg := w.cfg
+	if len(cfg.AllowList) == 0 && len(cfg.RemoteAllowList) == 0 && len(cfg.InsideAllowList) == 0 {
+		return
+	}
+	w.acl = cn.NewACL(cfg.Name)
+	w.aclRemoteSet = cn.NewIPSet(cfg.Name+"_acl_r", "hash:net")
+	w.aclInsideSet = cn.NewIPSet(cfg.Name+"_acl_i", "hash:net")
+	w.aclRemote = make(map[string]bool)
+	w.aclInside = make(map[string]bool)
+	w.aclOverride = make(map[string]*cn.IPSet)
+	w.aclOverRemote = make(map[string]map[string]bool)
+
+	w.fire.Filter.For.AddRule(cn.IpRule{
+		Output:  cfg.Bridge.Name,
+		SrcSet:  w.aclRemoteSet.Name,
+		Comment: "acl remote-allow-list",
+	})
+	w.fire.Filter.For.AddRule(cn.IpRule{
+		Input:   cfg.Bridge.Name,
+		DestSet: w.aclInsideSet.Name,
+		Comment: "acl allow-list",
+	})
+	w.syncACL()
+}
+
+// syncSet diffs an ipset's last-known membership against next, applying
+// only the CIDRs that actually changed.
+func (w *WorkerImpl) syncSet(set *cn.IPSet, prev, next map[string]bool) {
+	for cidr, allow := range next {
+		if !allow {
+			continue
+		}
+		if wasAllow, ok := prev[cidr]; ok && wasAllow {
+			continue
+		}
+		if out, err := set.Add(cidr); err != nil {
+			w.out.Warn("WorkerImpl.syncSet: add %s %s %s", cidr, out, err)
+		}
+	}
+	for cidr, wasAllow := range prev {
+		if !wasAllow {
+			continue
+		}
+		if allow, ok := next[cidr]; ok && allow {
+			continue
+		}
+		if out, err := set.Del(cidr); err != nil {
+			w.out.Warn("WorkerImpl.syncSet: del %s %s %s", cidr, out, err)
+		}
+	}
+}
+
+// syncACL re-materialises the trie and diffs the previously programmed
+// ipset members against the new rule set, resolving each configured CIDR
+// through the ACL so overlapping/conflicting entries within an axis are
+// settled the same way Allowed() would settle them at lookup time.
+func (w *WorkerImpl) syncACL() {
+	if w.acl == nil {
+		return
+	}
+	cfg := w.cfg
+	w.acl.Load(cfg.AllowList, cfg.RemoteAllowList, cn.InsideRules(cfg.InsideAllowList))
+
+	nextRemote := make(map[string]bool, len(cfg.RemoteAllowList))
+	for cidr := range cfg.RemoteAllowList {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			w.out.Warn("WorkerImpl.syncACL: invalid cidr %s", cidr)
+			continue
+		}
+		nextRemote[cidr] = w.acl.AllowedRemote(prefix.Addr())
+	}
+	w.syncSet(w.aclRemoteSet, w.aclRemote, nextRemote)
+	w.aclRemote = nextRemote
+
+	nextInside := make(map[string]bool, len(cfg.AllowList))
+	for cidr := range cfg.AllowList {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			w.out.Warn("WorkerImpl.syncACL: invalid cidr %s", cidr)
+			continue
+		}
+		nextInside[cidr] = w.acl.AllowedInside(prefix.Addr())
+	}
+	w.syncSet(w.aclInsideSet, w.aclInside, nextInside)
+	w.aclInside = nextInside
+
+	w.syncOverrides(cfg.InsideAllowList)
+}
+
+// syncOverrides programs one ipset per inside CIDR that has a
+// remote_allow_list override for site-to-site traffic, resolving each
+// remote sub-rule through acl.Allowed() so the override's own longest-
+// prefix-match semantics (not just its own flat list) decide membership.
+func (w *WorkerImpl) syncOverrides(insideAllowList map[string]map[string]bool) {
+	cfg := w.cfg
+	seen := make(map[string]bool, len(insideAllowList))
+	for insideCidr, rules := range insideAllowList {
+		insidePrefix, err := netip.ParsePrefix(insideCidr)
+		if err != nil {
+			w.out.Warn("WorkerImpl.syncOverrides: invalid inside cidr %s", insideCidr)
+			continue
+		}
+		seen[insideCidr] = true
+
+		set, ok := w.aclOverride[insideCidr]
+		if !ok {
+			set = cn.NewIPSet(cfg.Name+"_acl_o_"+strings.ReplaceAll(insideCidr, "/", "_"), "hash:net")
+			w.aclOverride[insideCidr] = set
+			w.fire.Filter.For.AddRule(cn.IpRule{
+				Output:  cfg.Bridge.Name,
+				Dest:    insideCidr,
+				SrcSet:  set.Name,
+				Comment: "acl inside-override " + insideCidr,
+			})
+		}
+
+		next := make(map[string]bool, len(rules))
+		for remoteCidr := range rules {
+			remotePrefix, err := netip.ParsePrefix(remoteCidr)
+			if err != nil {
+				w.out.Warn("WorkerImpl.syncOverrides: invalid remote cidr %s", remoteCidr)
+				continue
+			}
+			next[remoteCidr] = w.acl.Allowed(remotePrefix.Addr(), insidePrefix.Addr())
+		}
+		w.syncSet(set, w.aclOverRemote[insideCidr], next)
+		w.aclOverRemote[insideCidr] = next
+	}
+
+	for insideCidr, set := range w.aclOverride {
+		if seen[insideCidr] {
+			continue
+		}
+		set.Destroy()
+		delete(w.aclOverride, insideCidr)
+		delete(w.aclOverRemote, insideCidr)
+	}
+}
+
+// ReloadACL re-syncs the trie and ipsets from the current config, used
+// when the allow/deny lists are hot-reloaded without restarting the
+// worker.
+func (w *WorkerImpl) ReloadACL() {
+	if w.acl == nil {
+		w.initACL()
+		return
+	}
+	w.syncACL()
+}
+
 func (w *WorkerImpl) AddPhysical(bridge string, vlan int, output string) {
+	if w.bridger.Name() != bridge {
+		w.bridger = cn.NewBridger(w.cfg.Bridge.Driver, bridge)
+	}
+	if _, ok := w.bridger.(*cn.OvsCtl); ok {
+		if err := w.bridger.AddPort(output); err != nil {
+			w.out.Warn("WorkerImpl.AddPhysical %s", err)
+			return
+		}
+		if vlan > 0 {
+			if err := w.bridger.AddVlan(output, vlan); err != nil {
+				w.out.Warn("WorkerImpl.AddPhysical %s", err)
+			}
+		}
+		return
+	}
+
 	link, err := netlink.LinkByName(output)
 	if err != nil {
 		w.out.Error("WorkerImpl.LinkByName %s %s", output, err)
@@ -127,8 +316,7 @@ func (w *WorkerImpl) AddPhysical(bridge string, vlan int, output string) {
 		}
 		slaver = subLink.Name
 	}
-	br := cn.NewBrCtl(bridge, 0)
-	if err := br.AddPort(slaver); err != nil {
+	if err := w.bridger.AddPort(slaver); err != nil {
 		w.out.Warn("WorkerImpl.AddPhysical %s", err)
 	}
 }
@@ -136,6 +324,50 @@ func (w *WorkerImpl) AddPhysical(bridge string, vlan int, output string) {
 func (w *WorkerImpl) AddOutput(bridge string, port *LinuxPort) {
 	name := port.name
 	values := strings.SplitN(name, ":", 6)
+	if w.bridger.Name() != bridge {
+		w.bridger = cn.NewBridger(w.cfg.Bridge.Driver, bridge)
+	}
+	if ovs, ok := w.bridger.(*cn.OvsCtl); ok {
+		if values[0] == "gre" {
+			if port.link == "" {
+				port.link = co.GenName("ge-")
+			}
+			if err := ovs.AddTunnel(port.link, "gre", values[1], 0, 0); err != nil {
+				w.out.Error("WorkerImpl.AddOutput %s %s", name, err)
+				return
+			}
+		} else if values[0] == "vxlan" {
+			if len(values) < 3 {
+				w.out.Error("WorkerImpl.AddOutput %s wrong", name)
+				return
+			}
+			if port.link == "" {
+				port.link = co.GenName("vn-")
+			}
+			dport := 8472
+			if len(values) == 4 {
+				dport, _ = strconv.Atoi(values[3])
+			}
+			vni, _ := strconv.Atoi(values[2])
+			if err := ovs.AddTunnel(port.link, "vxlan", values[1], vni, dport); err != nil {
+				w.out.Error("WorkerImpl.AddOutput %s %s", name, err)
+				return
+			}
+		} else {
+			port.link = name
+			w.out.Info("WorkerImpl.AddOutput %s %s", port.link, port.name)
+			w.AddPhysical(bridge, port.vlan, port.link)
+			return
+		}
+		w.out.Info("WorkerImpl.AddOutput %s %s", port.link, port.name)
+		if port.vlan > 0 {
+			if err := ovs.AddVlan(port.link, port.vlan); err != nil {
+				w.out.Warn("WorkerImpl.AddOutput %s", err)
+			}
+		}
+		return
+	}
+
 	if values[0] == "gre" {
 		if port.link == "" {
 			port.link = co.GenName("ge-")
@@ -200,6 +432,7 @@ func (w *WorkerImpl) Start(v api.Switcher) {
 		Input:  cfg.Bridge.Name,
 		Output: cfg.Bridge.Name,
 	})
+	w.initACL()
 	if cfg.Bridge.Mss > 0 {
 		// forward to remote
 		fire.Mangle.Post.AddRule(cn.IpRule{
@@ -244,6 +477,15 @@ func (w *WorkerImpl) Start(v api.Switcher) {
 }
 
 func (w *WorkerImpl) DelPhysical(bridge string, vlan int, output string) {
+	if w.bridger.Name() != bridge {
+		w.bridger = cn.NewBridger(w.cfg.Bridge.Driver, bridge)
+	}
+	if _, ok := w.bridger.(*cn.OvsCtl); ok {
+		if err := w.bridger.DelPort(output); err != nil {
+			w.out.Warn("WorkerImpl.DelPhysical %s", err)
+		}
+		return
+	}
 	if vlan > 0 {
 		subLink := &netlink.Vlan{
 			LinkAttrs: netlink.LinkAttrs{
@@ -255,8 +497,7 @@ func (w *WorkerImpl) DelPhysical(bridge string, vlan int, output string) {
 			return
 		}
 	} else {
-		br := cn.NewBrCtl(bridge, 0)
-		if err := br.DelPort(output); err != nil {
+		if err := w.bridger.DelPort(output); err != nil {
 			w.out.Warn("WorkerImpl.DelPhysical %s", err)
 		}
 	}
@@ -264,8 +505,21 @@ func (w *WorkerImpl) DelPhysical(bridge string, vlan int, output string) {
 
 func (w *WorkerImpl) DelOutput(bridge string, port *LinuxPort) {
 	w.out.Info("WorkerImpl.DelOutput %s %s", port.link, port.name)
-	w.DelPhysical(bridge, port.vlan, port.link)
+	if w.bridger.Name() != bridge {
+		w.bridger = cn.NewBridger(w.cfg.Bridge.Driver, bridge)
+	}
 	values := strings.SplitN(port.name, ":", 6)
+	if ovs, ok := w.bridger.(*cn.OvsCtl); ok {
+		if values[0] == "gre" || values[0] == "vxlan" {
+			if err := ovs.DelTunnel(port.link); err != nil {
+				w.out.Warn("WorkerImpl.DelOutput %s", err)
+			}
+		} else {
+			w.DelPhysical(bridge, port.vlan, port.link)
+		}
+		return
+	}
+	w.DelPhysical(bridge, port.vlan, port.link)
 	if values[0] == "gre" {
 		link := &netlink.Gretap{
 			LinkAttrs: netlink.LinkAttrs{
@@ -304,6 +558,15 @@ func (w *WorkerImpl) Stop() {
 	w.outputs = nil
 	w.setR.Destroy()
 	w.setV.Destroy()
+	if w.aclRemoteSet != nil {
+		w.aclRemoteSet.Destroy()
+	}
+	if w.aclInsideSet != nil {
+		w.aclInsideSet.Destroy()
+	}
+	for _, set := range w.aclOverride {
+		set.Destroy()
+	}
 }
 
 func (w *WorkerImpl) String() string {
@@ -315,7 +578,7 @@ func (w *WorkerImpl) ID() string {
 }
 
 func (w *WorkerImpl) Bridge() cn.Bridger {
-	return nil
+	return w.bridger
 }
 
 func (w *WorkerImpl) Config() *co.Network {
@@ -326,6 +589,10 @@ func (w *WorkerImpl) Subnet() string {
 	return ""
 }
 
+func (w *WorkerImpl) Outputs() []*LinuxPort {
+	return w.outputs
+}
+
 func (w *WorkerImpl) Reload(v api.Switcher) {
 }
 